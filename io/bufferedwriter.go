@@ -29,10 +29,49 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Ticker is the subset of time.Ticker that BufferedWriter depends on, so
+// that tests can substitute a fake one.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Clock abstracts time so that the periodic flusher can be driven
+// deterministically in tests instead of relying on real sleeps.
+type Clock interface {
+	NewTicker(d time.Duration) Ticker
+	Now() time.Time
+}
+
+// systemClock is the default Clock, backed by the real time package.
+type systemClock struct{}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
 // BufferedWriter stores data in memory and flushes it every flushPeriod or when buffer is full
 type BufferedWriter struct {
 	flushPeriod       time.Duration // data flushes interval (in microseconds)
@@ -40,45 +79,151 @@ type BufferedWriter struct {
 	innerWriter       io.Writer     // inner writer
 	buffer            *bufio.Writer // buffered wrapper for inner writer
 	bufferSizeInBytes int           // max size of data chunk in bytes
+	clock             Clock         // source of tickers and time, overridable in tests
+	onFlushError      func(error)   // invoked from the periodic flusher when a flush fails
+	// lastFlushErr is the sticky error from the most recent flush, set by
+	// either a Write-driven flush or the periodic flusher. The next call to
+	// Write or WriteBuffers surfaces it to its caller once, then resets the
+	// underlying bufio.Writer and clears it, so a transient failure is
+	// reported instead of silently dropped, while still self-healing on the
+	// following call once the inner writer recovers. The bytes that failed
+	// to flush are dropped either way, since bufio.Writer has no way to
+	// replay them once it has latched an error.
+	lastFlushErr error
+	done         chan struct{} // closed to stop flushPeriodically
+	stopOnce     sync.Once     // makes Stop idempotent
 }
 
-// NewBufferedWriter creates a new buffered writer struct.
-// bufferSizeInBytes -- size of memory buffer in bytes
-// flushPeriod -- period in which data flushes from memory buffer in milliseconds. 0 - turn off this functionality
-func NewBufferedWriter(innerWriter io.Writer, bufferSizeInBytes int, flushPeriod time.Duration) (*BufferedWriter, error) {
+const (
+	defaultBufferSizeInBytes = 256 * 1024
+	defaultFlushInterval     = 30 * time.Second
+)
+
+// config holds the settings assembled from Option values passed to
+// NewBufferedWriterWithOptions.
+type config struct {
+	bufferSizeInBytes int
+	flushPeriod       time.Duration
+	clock             Clock
+	onFlushError      func(error)
+}
+
+// Option configures a BufferedWriter created via NewBufferedWriterWithOptions.
+type Option func(*config)
+
+// WithBufferSize sets the size, in bytes, of the in-memory buffer.
+func WithBufferSize(bufferSizeInBytes int) Option {
+	return func(c *config) {
+		c.bufferSizeInBytes = bufferSizeInBytes
+	}
+}
+
+// WithFlushInterval sets the period between automatic background flushes.
+// A value of 0 disables the background flusher.
+func WithFlushInterval(flushPeriod time.Duration) Option {
+	return func(c *config) {
+		c.flushPeriod = flushPeriod
+	}
+}
+
+// WithClock overrides the source of tickers and time, which is useful for
+// driving the periodic flusher deterministically in tests.
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		c.clock = clock
+	}
+}
+
+// WithOnFlushError registers a callback invoked from the periodic flusher
+// whenever a background flush fails.
+func WithOnFlushError(onFlushError func(error)) Option {
+	return func(c *config) {
+		c.onFlushError = onFlushError
+	}
+}
+
+// NewBufferedWriterWithOptions creates a new buffered writer, applying the
+// given options on top of sensible defaults: a 256 KiB buffer flushed every
+// 30 seconds using the system clock.
+func NewBufferedWriterWithOptions(innerWriter io.Writer, opts ...Option) (*BufferedWriter, error) {
 
 	if innerWriter == nil {
 		return nil, errors.New("argument is nil: innerWriter")
 	}
-	if flushPeriod < 0 {
-		return nil, fmt.Errorf("flushPeriod can not be less than 0. Got: %d", flushPeriod)
+
+	cfg := &config{
+		bufferSizeInBytes: defaultBufferSizeInBytes,
+		flushPeriod:       defaultFlushInterval,
+		clock:             systemClock{},
 	}
 
-	if bufferSizeInBytes <= 0 {
-		return nil, fmt.Errorf("bufferSizeInBytes can not be less or equal to 0. Got: %d", bufferSizeInBytes)
+	for _, opt := range opts {
+		opt(cfg)
 	}
 
-	buffer := bufio.NewWriterSize(innerWriter, bufferSizeInBytes)
+	if cfg.flushPeriod < 0 {
+		return nil, fmt.Errorf("flushPeriod can not be less than 0. Got: %d", cfg.flushPeriod)
+	}
+
+	if cfg.bufferSizeInBytes <= 0 {
+		return nil, fmt.Errorf("bufferSizeInBytes can not be less or equal to 0. Got: %d", cfg.bufferSizeInBytes)
+	}
 
-	/*if err != nil {
-		return nil, err
-	}*/
+	buffer := bufio.NewWriterSize(innerWriter, cfg.bufferSizeInBytes)
 
 	newWriter := new(BufferedWriter)
 
 	newWriter.innerWriter = innerWriter
 	newWriter.buffer = buffer
-	newWriter.bufferSizeInBytes = bufferSizeInBytes
-	newWriter.flushPeriod = flushPeriod * 1e6
+	newWriter.bufferSizeInBytes = cfg.bufferSizeInBytes
+	newWriter.flushPeriod = cfg.flushPeriod
 	newWriter.bufferMutex = new(sync.Mutex)
+	newWriter.clock = cfg.clock
+	newWriter.onFlushError = cfg.onFlushError
+	newWriter.done = make(chan struct{})
 
-	if flushPeriod != 0 {
+	if cfg.flushPeriod != 0 {
 		go newWriter.flushPeriodically()
 	}
 
 	return newWriter, nil
 }
 
+// NewBufferedWriter creates a new buffered writer struct.
+// bufferSizeInBytes -- size of memory buffer in bytes
+// flushPeriod -- period in which data flushes from memory buffer in milliseconds. 0 - turn off this functionality
+func NewBufferedWriter(innerWriter io.Writer, bufferSizeInBytes int, flushPeriod time.Duration) (*BufferedWriter, error) {
+	if flushPeriod < 0 {
+		return nil, fmt.Errorf("flushPeriod can not be less than 0. Got: %d", flushPeriod)
+	}
+
+	return NewBufferedWriterWithOptions(
+		innerWriter,
+		WithBufferSize(bufferSizeInBytes),
+		WithFlushInterval(flushPeriod*1e6),
+	)
+}
+
+// recoverFromFlushError surfaces a previous flush failure to its caller
+// exactly once, then gives the inner writer a chance to recover instead of
+// bricking the writer forever: bufio.Writer latches its own error
+// permanently once a Flush fails, so simply retrying Flush would keep
+// returning the stale error even after the inner writer works again.
+// Resetting it clears that latch at the cost of the already-buffered bytes,
+// which failed to flush and cannot be replayed. Callers must hold
+// bufferMutex.
+func (bufWriter *BufferedWriter) recoverFromFlushError() error {
+	err := bufWriter.lastFlushErr
+	if err == nil {
+		return nil
+	}
+
+	bufWriter.buffer.Reset(bufWriter.innerWriter)
+	bufWriter.lastFlushErr = nil
+
+	return err
+}
+
 func (bufWriter *BufferedWriter) writeBigChunk(bytes []byte) (n int, err error) {
 	bufferedLen := bufWriter.buffer.Buffered()
 
@@ -92,11 +237,20 @@ func (bufWriter *BufferedWriter) writeBigChunk(bytes []byte) (n int, err error)
 }
 
 // Sends data to buffer manager. Waits until all buffers are full.
+//
+// If a previous flush failed, Write returns that sticky error once (without
+// writing bytes) and then resets the buffer so the inner writer gets another
+// chance on the next call, rather than permanently bricking the writer; see
+// recoverFromFlushError.
 func (bufWriter *BufferedWriter) Write(bytes []byte) (n int, err error) {
 
 	bufWriter.bufferMutex.Lock()
 	defer bufWriter.bufferMutex.Unlock()
 
+	if err = bufWriter.recoverFromFlushError(); err != nil {
+		return 0, err
+	}
+
 	bytesLen := len(bytes)
 
 	if bytesLen > bufWriter.bufferSizeInBytes {
@@ -115,13 +269,109 @@ func (bufWriter *BufferedWriter) Write(bytes []byte) (n int, err error) {
 	return len(bytes), nil
 }
 
+// WriteBuffers writes bufs, avoiding a copy into the in-memory buffer when
+// it doesn't pay off: once the accumulated length exceeds the buffer's
+// capacity, the buffer is flushed and bufs is handed directly to the inner
+// writer via net.Buffers.WriteTo, letting the OS use writev(2) where
+// supported. When the total fits within the buffer's capacity it is still
+// appended to the buffered writer, flushing first only if needed to make
+// room, just like Write. If a previous flush failed, WriteBuffers returns
+// that sticky error once (without writing bufs); see recoverFromFlushError.
+func (bufWriter *BufferedWriter) WriteBuffers(bufs net.Buffers) (n int64, err error) {
+	bufWriter.bufferMutex.Lock()
+	defer bufWriter.bufferMutex.Unlock()
+
+	if err = bufWriter.recoverFromFlushError(); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, buf := range bufs {
+		total += int64(len(buf))
+	}
+
+	if total > int64(bufWriter.bufferSizeInBytes) {
+		if _, err = bufWriter.flushInner(); err != nil {
+			return 0, err
+		}
+
+		return bufs.WriteTo(bufWriter.innerWriter)
+	}
+
+	if total > int64(bufWriter.buffer.Available()) {
+		if _, err = bufWriter.flushInner(); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, buf := range bufs {
+		written, writeErr := bufWriter.buffer.Write(buf)
+		n += int64(written)
+		if writeErr != nil {
+			return n, writeErr
+		}
+	}
+
+	return n, nil
+}
+
+// Close stops the background flusher, flushes any remaining buffered data
+// and closes the inner writer if it implements io.Closer.
 func (bufWriter *BufferedWriter) Close() error {
-	closer, ok := bufWriter.innerWriter.(io.Closer)
-	if ok {
-		return closer.Close()
+	return bufWriter.Stop()
+}
+
+// Stop cancels the periodic flusher, flushes any remaining buffered data to
+// the inner writer and closes it if it implements io.Closer. It is safe to
+// call Stop more than once; only the first call does any work.
+func (bufWriter *BufferedWriter) Stop() error {
+	var err error
+
+	bufWriter.stopOnce.Do(func() {
+		close(bufWriter.done)
+
+		flushErr := bufWriter.Sync()
+
+		var closeErr error
+		if closer, ok := bufWriter.innerWriter.(io.Closer); ok {
+			closeErr = closer.Close()
+		}
+
+		err = combineErrors(flushErr, closeErr)
+	})
+
+	return err
+}
+
+// Sync flushes any data buffered in memory to the inner writer.
+func (bufWriter *BufferedWriter) Sync() error {
+	bufWriter.bufferMutex.Lock()
+	defer bufWriter.bufferMutex.Unlock()
+
+	_, err := bufWriter.flushInner()
+	return err
+}
+
+func combineErrors(errs ...error) error {
+	var nonNil []error
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
 	}
 
-	return nil
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	default:
+		msgs := make([]string, len(nonNil))
+		for i, err := range nonNil {
+			msgs[i] = err.Error()
+		}
+		return errors.New(strings.Join(msgs, "; "))
+	}
 }
 
 func (bufWriter *BufferedWriter) Flush() {
@@ -132,26 +382,42 @@ func (bufWriter *BufferedWriter) Flush() {
 	bufWriter.flushInner()
 }
 
+// flushInner flushes the buffer and records the result as the sticky
+// lastFlushErr. Callers must hold bufferMutex.
 func (bufWriter *BufferedWriter) flushInner() (n int, err error) {
-	bufferedLen := bufWriter.buffer.Buffered()
-	flushErr := bufWriter.buffer.Flush()
+	bufferedBefore := bufWriter.buffer.Buffered()
+	err = bufWriter.buffer.Flush()
+	n = bufferedBefore - bufWriter.buffer.Buffered()
+
+	bufWriter.lastFlushErr = err
 
-	return bufWriter.buffer.Buffered() - bufferedLen, flushErr
+	return n, err
 }
 
-func (bufWriter *BufferedWriter) flushBuffer() {
+// flushBuffer flushes the buffer on behalf of the periodic flusher and
+// returns any error so it can be surfaced via the onFlushError callback.
+func (bufWriter *BufferedWriter) flushBuffer() error {
 	bufWriter.bufferMutex.Lock()
 	defer bufWriter.bufferMutex.Unlock()
 
-	bufWriter.buffer.Flush()
+	_, err := bufWriter.flushInner()
+	return err
 }
 
 func (bufWriter *BufferedWriter) flushPeriodically() {
 	if bufWriter.flushPeriod > 0 {
-		ticker := time.NewTicker(bufWriter.flushPeriod)
+		ticker := bufWriter.clock.NewTicker(bufWriter.flushPeriod)
+		defer ticker.Stop()
+
 		for {
-			<-ticker.C
-			bufWriter.flushBuffer()
+			select {
+			case <-ticker.C():
+				if err := bufWriter.flushBuffer(); err != nil && bufWriter.onFlushError != nil {
+					bufWriter.onFlushError(err)
+				}
+			case <-bufWriter.done:
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,473 @@
+package io
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orderingWriteCloser records each Write/Close call, in order, so tests can
+// assert that buffered data reaches it before it is closed.
+type orderingWriteCloser struct {
+	mu     sync.Mutex
+	data   []byte
+	closed bool
+	order  []string
+}
+
+func (w *orderingWriteCloser) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.data = append(w.data, p...)
+	w.order = append(w.order, "write")
+
+	return len(p), nil
+}
+
+func (w *orderingWriteCloser) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	w.order = append(w.order, "close")
+
+	return nil
+}
+
+func (w *orderingWriteCloser) closeCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	count := 0
+	for _, event := range w.order {
+		if event == "close" {
+			count++
+		}
+	}
+
+	return count
+}
+
+// failingWriteCloser always fails both Write and Close, so tests can assert
+// on how their errors get combined.
+type failingWriteCloser struct {
+	writeErr error
+	closeErr error
+}
+
+func (w *failingWriteCloser) Write(p []byte) (int, error) {
+	return 0, w.writeErr
+}
+
+func (w *failingWriteCloser) Close() error {
+	return w.closeErr
+}
+
+// flakyWriter fails every Write while down, and succeeds once flipped back
+// up, so tests can simulate a transient inner-writer outage.
+type flakyWriter struct {
+	mu   sync.Mutex
+	down bool
+	data []byte
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.down {
+		return 0, errors.New("inner writer is down")
+	}
+
+	w.data = append(w.data, p...)
+
+	return len(p), nil
+}
+
+func (w *flakyWriter) setDown(down bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.down = down
+}
+
+func (w *flakyWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return string(w.data)
+}
+
+// fakeTicker is a Ticker whose channel is fed manually by a fakeClock,
+// instead of firing on a real-time schedule.
+type fakeTicker struct {
+	c chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {}
+
+// fakeClock is a Clock that lets tests advance the flush interval
+// deterministically instead of waiting on real sleeps. ready is signaled
+// each time a ticker is created, so tests can wait for flushPeriodically to
+// have actually registered one before ticking it.
+type fakeClock struct {
+	mu      sync.Mutex
+	tickers []*fakeTicker
+	ready   chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{ready: make(chan struct{}, 1)}
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	ticker := &fakeTicker{c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, ticker)
+	c.mu.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+
+	return ticker
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Time{}
+}
+
+// tick fires every ticker handed out so far, simulating flushPeriod elapsing.
+func (c *fakeClock) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ticker := range c.tickers {
+		ticker.c <- time.Time{}
+	}
+}
+
+// syncWriteCloser is an io.Writer that signals on a channel after each
+// Write, giving tests a synchronization point instead of polling.
+type syncWriteCloser struct {
+	mu      sync.Mutex
+	data    []byte
+	written chan struct{}
+}
+
+func newSyncWriteCloser() *syncWriteCloser {
+	return &syncWriteCloser{written: make(chan struct{}, 1)}
+}
+
+func (w *syncWriteCloser) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.data = append(w.data, p...)
+	w.mu.Unlock()
+
+	select {
+	case w.written <- struct{}{}:
+	default:
+	}
+
+	return len(p), nil
+}
+
+func (w *syncWriteCloser) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return string(w.data)
+}
+
+func TestNewBufferedWriterReportsNegativeFlushPeriodInOriginalUnits(t *testing.T) {
+	_, err := NewBufferedWriter(&syncWriteCloser{}, 1024, -5)
+	if err == nil {
+		t.Fatal("expected an error for a negative flushPeriod")
+	}
+
+	if !strings.Contains(err.Error(), "Got: -5") {
+		t.Fatalf("expected error to report the unscaled flushPeriod, got: %v", err)
+	}
+}
+
+func TestBufferedWriterWriteSurfacesStickyErrorOnceThenSelfHeals(t *testing.T) {
+	inner := &flakyWriter{down: true}
+
+	bw, err := NewBufferedWriterWithOptions(inner, WithBufferSize(4), WithFlushInterval(0))
+	if err != nil {
+		t.Fatalf("NewBufferedWriterWithOptions returned error: %v", err)
+	}
+
+	if _, err := bw.Write([]byte("ab")); err != nil {
+		t.Fatalf("buffered Write should not fail: %v", err)
+	}
+	if _, err := bw.Write([]byte("cd")); err != nil {
+		t.Fatalf("buffered Write should not fail: %v", err)
+	}
+
+	// The buffer is now full; one more byte forces a flush, which fails
+	// because the inner writer is down, and should leave a sticky error.
+	if _, err := bw.Write([]byte("e")); err == nil {
+		t.Fatal("expected Write to surface the inner writer's error")
+	}
+
+	inner.setDown(false)
+
+	// The very next Write must still surface that sticky error -- even
+	// though the inner writer has since recovered -- rather than silently
+	// dropping the failure notification. It writes nothing in the process.
+	if n, err := bw.Write([]byte("f")); err == nil {
+		t.Fatal("expected the next Write to surface the stale flush error once")
+	} else if n != 0 {
+		t.Fatalf("n = %d, want 0 when surfacing the stale error", n)
+	}
+
+	// Having been surfaced once, the error is now cleared and the writer
+	// self-heals: a further Write goes through normally.
+	n, err := bw.Write([]byte("g"))
+	if err != nil {
+		t.Fatalf("Write should recover after the stale error was surfaced, got: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("n = %d, want 1", n)
+	}
+
+	if err := bw.Sync(); err != nil {
+		t.Fatalf("Sync returned error after recovery: %v", err)
+	}
+
+	if got := inner.String(); got != "g" {
+		t.Fatalf("inner writer = %q, want %q", got, "g")
+	}
+}
+
+func TestBufferedWriterWriteSurfacesPeriodicFlushErrorThenSelfHeals(t *testing.T) {
+	inner := &flakyWriter{down: true}
+	clock := newFakeClock()
+	flushAttempted := make(chan error, 1)
+
+	bw, err := NewBufferedWriterWithOptions(inner,
+		WithBufferSize(1024),
+		WithFlushInterval(time.Second),
+		WithClock(clock),
+		WithOnFlushError(func(err error) {
+			select {
+			case flushAttempted <- err:
+			default:
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("NewBufferedWriterWithOptions returned error: %v", err)
+	}
+	defer bw.Stop()
+
+	select {
+	case <-clock.ready:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the periodic flusher to start")
+	}
+
+	if _, err := bw.Write([]byte("data")); err != nil {
+		t.Fatalf("buffered Write should not fail: %v", err)
+	}
+
+	clock.tick()
+
+	// Wait for the periodic flusher -- not a caller's Write -- to actually
+	// hit the failing inner writer. WithOnFlushError is only used here as a
+	// test synchronization signal; the assertions below are about what
+	// Write itself returns, independent of that callback.
+	select {
+	case <-flushAttempted:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the periodic flush to fail")
+	}
+
+	inner.setDown(false)
+
+	// A Write with no knowledge of the background failure must still learn
+	// about it: the sticky error set by flushPeriodically has to surface
+	// here, not be silently reset away.
+	if _, err := bw.Write([]byte("more")); err == nil {
+		t.Fatal("expected Write to surface the error left by the periodic flusher")
+	}
+
+	// The writer should be usable again on the following call.
+	if _, err := bw.Write([]byte("more")); err != nil {
+		t.Fatalf("Write should recover after the stale error was surfaced, got: %v", err)
+	}
+
+	if err := bw.Sync(); err != nil {
+		t.Fatalf("Sync returned error after recovery: %v", err)
+	}
+
+	if got := inner.String(); got != "more" {
+		t.Fatalf("inner writer = %q, want %q", got, "more")
+	}
+}
+
+func TestBufferedWriterWriteBuffersFittingCapacityStaysBuffered(t *testing.T) {
+	inner := &orderingWriteCloser{}
+
+	bw, err := NewBufferedWriterWithOptions(inner, WithBufferSize(10), WithFlushInterval(0))
+	if err != nil {
+		t.Fatalf("NewBufferedWriterWithOptions returned error: %v", err)
+	}
+
+	if _, err := bw.Write([]byte("12345678")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	// 3 bytes don't fit in the 2 bytes currently available, but do fit
+	// within the buffer's full 10-byte capacity, so this should flush the
+	// existing bytes to make room and then buffer the new ones rather than
+	// bypassing straight to the inner writer.
+	n, err := bw.WriteBuffers(net.Buffers{[]byte("a"), []byte("bc")})
+	if err != nil {
+		t.Fatalf("WriteBuffers returned error: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("n = %d, want 3", n)
+	}
+
+	if got := string(inner.data); got != "12345678" {
+		t.Fatalf("expected only the prior flush to reach the inner writer, got %q", got)
+	}
+	if len(inner.order) != 1 {
+		t.Fatalf("expected exactly one write to the inner writer, got %d: %v", len(inner.order), inner.order)
+	}
+
+	if err := bw.Sync(); err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+
+	if got := string(inner.data); got != "12345678abc" {
+		t.Fatalf("inner writer = %q, want %q", got, "12345678abc")
+	}
+}
+
+func TestBufferedWriterFlushesOnClockTick(t *testing.T) {
+	inner := newSyncWriteCloser()
+	clock := newFakeClock()
+
+	bw, err := NewBufferedWriterWithOptions(inner,
+		WithBufferSize(1024),
+		WithFlushInterval(time.Second),
+		WithClock(clock),
+	)
+	if err != nil {
+		t.Fatalf("NewBufferedWriterWithOptions returned error: %v", err)
+	}
+	defer bw.Stop()
+
+	select {
+	case <-clock.ready:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the periodic flusher to start")
+	}
+
+	if _, err := bw.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	if got := inner.String(); got != "" {
+		t.Fatalf("expected data to stay buffered before the tick, inner has %q", got)
+	}
+
+	clock.tick()
+
+	select {
+	case <-inner.written:
+	case <-time.After(time.Second):
+		t.Fatal("expected a flush after the clock ticked")
+	}
+
+	if got := inner.String(); got != "hello" {
+		t.Fatalf("inner writer = %q, want %q", got, "hello")
+	}
+}
+
+func TestBufferedWriterStopFlushesBeforeClosing(t *testing.T) {
+	inner := &orderingWriteCloser{}
+
+	bw, err := NewBufferedWriterWithOptions(inner, WithBufferSize(1024), WithFlushInterval(0))
+	if err != nil {
+		t.Fatalf("NewBufferedWriterWithOptions returned error: %v", err)
+	}
+
+	if _, err := bw.Write([]byte("pending")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+
+	if err := bw.Stop(); err != nil {
+		t.Fatalf("Stop returned error: %v", err)
+	}
+
+	if string(inner.data) != "pending" {
+		t.Fatalf("inner writer = %q, want %q", inner.data, "pending")
+	}
+
+	if !inner.closed {
+		t.Fatal("expected inner writer to be closed")
+	}
+
+	if len(inner.order) != 2 || inner.order[0] != "write" || inner.order[1] != "close" {
+		t.Fatalf("expected buffered data to be written before closing, got order %v", inner.order)
+	}
+}
+
+func TestBufferedWriterStopIsIdempotent(t *testing.T) {
+	inner := &orderingWriteCloser{}
+
+	bw, err := NewBufferedWriterWithOptions(inner, WithBufferSize(1024), WithFlushInterval(0))
+	if err != nil {
+		t.Fatalf("NewBufferedWriterWithOptions returned error: %v", err)
+	}
+
+	if err := bw.Stop(); err != nil {
+		t.Fatalf("first Stop returned error: %v", err)
+	}
+
+	if err := bw.Stop(); err != nil {
+		t.Fatalf("second Stop returned error: %v", err)
+	}
+
+	if got := inner.closeCount(); got != 1 {
+		t.Fatalf("expected exactly one Close call across two Stop calls, got %d", got)
+	}
+}
+
+func TestBufferedWriterStopCombinesFlushAndCloseErrors(t *testing.T) {
+	inner := &failingWriteCloser{
+		writeErr: errors.New("flush failed"),
+		closeErr: errors.New("close failed"),
+	}
+
+	bw, err := NewBufferedWriterWithOptions(inner, WithBufferSize(1024), WithFlushInterval(0))
+	if err != nil {
+		t.Fatalf("NewBufferedWriterWithOptions returned error: %v", err)
+	}
+
+	if _, err := bw.Write([]byte("data")); err != nil {
+		t.Fatalf("buffered Write should not fail: %v", err)
+	}
+
+	err = bw.Stop()
+	if err == nil {
+		t.Fatal("expected Stop to return a combined error")
+	}
+
+	if !strings.Contains(err.Error(), "flush failed") || !strings.Contains(err.Error(), "close failed") {
+		t.Fatalf("expected combined error to mention both failures, got: %v", err)
+	}
+}